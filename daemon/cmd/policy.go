@@ -22,7 +22,6 @@ import (
 	authMonitor "github.com/cilium/cilium/pkg/auth/monitor"
 	"github.com/cilium/cilium/pkg/crypto/certificatemanager"
 	"github.com/cilium/cilium/pkg/endpoint"
-	"github.com/cilium/cilium/pkg/endpoint/regeneration"
 	"github.com/cilium/cilium/pkg/endpointmanager"
 	"github.com/cilium/cilium/pkg/envoy"
 	"github.com/cilium/cilium/pkg/eventqueue"
@@ -67,6 +66,46 @@ func (d *Daemon) initPolicy(epMgr endpointmanager.EndpointManager) error {
 
 	d.monitorAgent.RegisterNewConsumer(authMonitor.AddAuthManager(auth.NewAuthManager(epMgr)))
 
+	d.policyTxns = newPolicyTxnManager()
+	d.reapExpiredPolicyTxns(d.ctx)
+	d.policyReactionQueue = newPolicyReactionWorkQueue()
+
+	d.cidrReleaseGC = newCIDRReleaseGC(d.ipcache.ReleaseCIDRIdentitiesByCIDR)
+	d.startCIDRReleaseGC(d.ctx)
+
+	d.policySources = newPolicySourceRegistry()
+
+	d.policyRetention = newPolicyRetentionStore(policyRetentionConfig{
+		MaxRevisions: option.Config.PolicyRetentionMaxRevisions,
+		MaxAge:       option.Config.PolicyRetentionMaxAge,
+	})
+
+	d.policyAdmission = newPolicyAdmissionChain()
+	// PolicyAdmissionWebhooks is []policy.AdmissionWebhookConfig rather than
+	// a daemon/cmd type: pkg/option can't import daemon/cmd, so the config
+	// shape lives alongside the rule types it validates instead.
+	for _, wh := range option.Config.PolicyAdmissionWebhooks {
+		d.policyAdmission.Register(newWebhookValidator(wh))
+	}
+
+	d.policyWatch = newPolicyWatchBroker()
+
+	if option.Config.PolicyRBACModelPath != "" {
+		enforcer, err := newPolicyEnforcer(option.Config.PolicyRBACModelPath, option.Config.PolicyRBACPolicyPath)
+		if err != nil {
+			return fmt.Errorf("failed to initialize policy RBAC enforcer: %w", err)
+		}
+		d.policyEnforcer = enforcer
+
+		if option.Config.PolicyRBACTokensPath != "" {
+			tokens, err := loadBearerTokenStore(option.Config.PolicyRBACTokensPath)
+			if err != nil {
+				return fmt.Errorf("failed to load policy RBAC bearer token store: %w", err)
+			}
+			d.policyRBACTokens = tokens
+		}
+	}
+
 	return nil
 }
 
@@ -288,6 +327,13 @@ func (d *Daemon) policyAdd(sourceRules policyAPI.Rules, opts *policy.AddOptions,
 		}
 	}
 
+	// If any of these prefixes have a pending deferred release from a
+	// previous policyDelete/policyAdd within the CIDR identity GC grace
+	// period, cancel it so the existing identity is reused instead of
+	// churning the BPF maps with a release followed immediately by a
+	// re-allocation.
+	d.cidrReleaseGC.cancel(prefixes)
+
 	// Any newly allocated identities MUST be upserted to the ipcache if
 	// no error is returned. This is postponed to the rule reaction queue
 	// to be done after the affected endpoints have been regenerated,
@@ -331,25 +377,14 @@ func (d *Daemon) policyAdd(sourceRules policyAPI.Rules, opts *policy.AddOptions,
 
 	endpointsToRegen := policy.NewEndpointSet(nil)
 
-	if opts != nil {
-		if opts.Replace {
-			for _, r := range sourceRules {
-				oldRules := d.policy.SearchRLocked(r.Labels)
-				removedPrefixes = append(removedPrefixes, policy.GetCIDRPrefixes(oldRules)...)
-				if len(oldRules) > 0 {
-					deletedRules, _, _ := d.policy.DeleteByLabelsLocked(r.Labels)
-					deletedRules.UpdateRulesEndpointsCaches(endpointsToBumpRevision, endpointsToRegen, &policySelectionWG)
-				}
-			}
-		}
-		if len(opts.ReplaceWithLabels) > 0 {
-			oldRules := d.policy.SearchRLocked(opts.ReplaceWithLabels)
-			removedPrefixes = append(removedPrefixes, policy.GetCIDRPrefixes(oldRules)...)
-			if len(oldRules) > 0 {
-				deletedRules, _, _ := d.policy.DeleteByLabelsLocked(opts.ReplaceWithLabels)
-				deletedRules.UpdateRulesEndpointsCaches(endpointsToBumpRevision, endpointsToRegen, &policySelectionWG)
-			}
-		}
+	// rulesToReplace is shared with computePolicyAddPlan so that POST
+	// /policy/validate can never disagree with the real PolicyAdd path
+	// about which existing rules an add would replace.
+	for _, lbls := range d.rulesToReplace(sourceRules, opts) {
+		oldRules := d.policy.SearchRLocked(lbls)
+		removedPrefixes = append(removedPrefixes, policy.GetCIDRPrefixes(oldRules)...)
+		deletedRules, _, _ := d.policy.DeleteByLabelsLocked(lbls)
+		deletedRules.UpdateRulesEndpointsCaches(endpointsToBumpRevision, endpointsToRegen, &policySelectionWG)
 	}
 
 	addedRules, newRev := d.policy.AddListLocked(sourceRules)
@@ -363,6 +398,8 @@ func (d *Daemon) policyAdd(sourceRules policyAPI.Rules, opts *policy.AddOptions,
 
 	addedRules.UpdateRulesEndpointsCaches(endpointsToBumpRevision, endpointsToRegen, &policySelectionWG)
 
+	incremental := opts != nil && opts.Incremental
+
 	d.policy.Mutex.Unlock()
 
 	if newPrefixLengths && !bpfIPCache.BackedByLPM() {
@@ -391,7 +428,7 @@ func (d *Daemon) policyAdd(sourceRules policyAPI.Rules, opts *policy.AddOptions,
 	// and will trigger deletions for those that are no longer used.
 	if len(removedPrefixes) > 0 {
 		logger.WithField("prefixes", removedPrefixes).Debug("Decrementing replaced CIDR refcounts when adding rules")
-		d.ipcache.ReleaseCIDRIdentitiesByCIDR(removedPrefixes)
+		d.cidrReleaseGC.scheduleRelease(removedPrefixes)
 		d.prefixLengths.Delete(removedPrefixes)
 	}
 
@@ -406,6 +443,17 @@ func (d *Daemon) policyAdd(sourceRules policyAPI.Rules, opts *policy.AddOptions,
 		logger.WithError(err).WithField(logfields.PolicyRevision, newRev).Warn("Failed to send policy update as monitor notification")
 	}
 
+	if opts != nil && opts.Source != "" {
+		d.policySources.recordSourceRules(opts.Source, sourceRules)
+	}
+	d.recordPolicySnapshot(newRev, source)
+	d.policyWatch.Publish(PolicyChangeEvent{
+		Revision:          newRev,
+		Source:            source,
+		AddedLabels:       labels,
+		AffectedSelectors: ruleSelectors(sourceRules),
+	})
+
 	// Only regenerate endpoints which are needed to be regenerated as a
 	// result of the rule update. The rules which were imported most likely
 	// do not select all endpoints in the policy repository (and may not
@@ -423,6 +471,8 @@ func (d *Daemon) policyAdd(sourceRules policyAPI.Rules, opts *policy.AddOptions,
 		endpointsToRegen:  endpointsToRegen,
 		newRev:            newRev,
 		upsertIdentities:  newlyAllocatedIdentities,
+		incrementalRules:  sourceRules,
+		incremental:       incremental,
 	}
 
 	ev := eventqueue.NewEvent(r)
@@ -448,6 +498,8 @@ type PolicyReactionEvent struct {
 	newRev            uint64
 	upsertIdentities  map[netip.Prefix]*identity.Identity // deferred CIDR identity upserts, if any
 	releasePrefixes   []netip.Prefix                      // deferred CIDR identity deletes, if any
+	incrementalRules  policyAPI.Rules                     // rules to diff against endpoints selected for regeneration
+	incremental       bool                                // apply incrementalRules as a policy map delta instead of a full regen
 }
 
 // Handle implements pkg/eventqueue/EventHandler interface.
@@ -455,26 +507,33 @@ func (r *PolicyReactionEvent) Handle(res chan interface{}) {
 	// Wait until we have calculated which endpoints need to be selected
 	// across multiple goroutines.
 	r.wg.Wait()
-	r.d.reactToRuleUpdates(r.epsToBumpRevision, r.endpointsToRegen, r.newRev, r.upsertIdentities, r.releasePrefixes)
+	r.d.reactToRuleUpdates(r.epsToBumpRevision, r.endpointsToRegen, r.newRev, r.upsertIdentities, r.releasePrefixes, r.incrementalRules, r.incremental)
 }
 
 // reactToRuleUpdates does the following:
-//   - regenerate all endpoints in epsToRegen
+//   - regenerate all endpoints in epsToRegen, unless incremental is set and
+//     ResolveMapChanges can compute a precise policy map delta for one
+//     instead: in that case the delta is applied directly to the endpoint's
+//     map and the endpoint only needs its revision bumped, skipping the full
+//     regeneration that motivated this path in the first place.
 //   - bump the policy revision of all endpoints not in epsToRegen, but which are
-//     in allEps, to revision rev.
+//     in allEps, to revision rev. These endpoints are not selected by the new
+//     rules at all, so nothing in their policy map can have changed.
 //   - wait for the regenerations to be finished
 //   - upsert or delete CIDR identities to the ipcache, as needed.
-func (d *Daemon) reactToRuleUpdates(epsToBumpRevision, epsToRegen *policy.EndpointSet, rev uint64, upsertIdentities map[netip.Prefix]*identity.Identity, releasePrefixes []netip.Prefix) {
+func (d *Daemon) reactToRuleUpdates(epsToBumpRevision, epsToRegen *policy.EndpointSet, rev uint64, upsertIdentities map[netip.Prefix]*identity.Identity, releasePrefixes []netip.Prefix, incrementalRules policyAPI.Rules, incremental bool) {
 	var enqueueWaitGroup sync.WaitGroup
 
-	// Release CIDR identities before regenerations have been started, if any. This makes sure
-	// the stale identities are not used in policy map classifications after we regenerate the
-	// endpoints below.
+	// Schedule CIDR identities for release, if any, rather than releasing
+	// them immediately: a grace period avoids spurious drops and BPF map
+	// churn when a prefix is deleted and re-added again shortly after,
+	// e.g. by a GitOps reconciler doing a delete-then-recreate.
 	if len(releasePrefixes) != 0 {
-		d.ipcache.ReleaseCIDRIdentitiesByCIDR(releasePrefixes)
+		d.cidrReleaseGC.scheduleRelease(releasePrefixes)
 	}
 
-	// Bump revision of endpoints which don't need to be regenerated.
+	// Endpoints which rules simply don't select are unaffected by the
+	// update; they just need their revision bumped.
 	epsToBumpRevision.ForEachGo(&enqueueWaitGroup, func(epp policy.Endpoint) {
 		if epp == nil {
 			return
@@ -482,26 +541,51 @@ func (d *Daemon) reactToRuleUpdates(epsToBumpRevision, epsToRegen *policy.Endpoi
 		epp.PolicyRevisionBumpEvent(rev)
 	})
 
-	// Regenerate all other endpoints.
-	regenMetadata := &regeneration.ExternalRegenerationMetadata{
-		Reason:            "policy rules added",
-		RegenerationLevel: regeneration.RegenerateWithoutDatapath,
-	}
+	// Endpoints rules does select would otherwise all go through a full
+	// regeneration. When incremental is set, try to substitute that with a
+	// targeted policy map diff instead; only endpoints for which that
+	// fails (or isn't attempted) fall through to the bounded regeneration
+	// workqueue below, rather than fanning out one goroutine per endpoint
+	// on every policy change.
+	var workItems []regenWorkItem
 	epsToRegen.ForEachGo(&enqueueWaitGroup, func(ep policy.Endpoint) {
-		if ep != nil {
-			switch e := ep.(type) {
-			case *endpoint.Endpoint:
-				// Do not wait for the returned channel as we want this to be
-				// ASync
-				e.RegenerateIfAlive(regenMetadata)
-			default:
-				log.Errorf("BUG: endpoint not type of *endpoint.Endpoint, received '%s' instead", e)
+		if ep == nil {
+			return
+		}
+		e, ok := ep.(*endpoint.Endpoint)
+		if !ok {
+			log.Errorf("BUG: endpoint not type of *endpoint.Endpoint, received '%s' instead", ep)
+			return
+		}
+		if incremental && len(incrementalRules) > 0 {
+			added, removed, resolvedOK := d.policy.ResolveMapChanges(e, incrementalRules, d.identityAllocator.GetIdentityCache())
+			if resolvedOK && (len(added) > 0 || len(removed) > 0) {
+				if err := e.ApplyPolicyMapDelta(added, removed); err == nil {
+					e.PolicyRevisionBumpEvent(rev)
+					return
+				} else {
+					log.WithError(err).WithField(logfields.PolicyRevision, rev).
+						Warn("Failed to apply incremental policy map delta, falling back to full regeneration")
+				}
 			}
 		}
+		d.policy.Mutex.RLock()
+		selectingRuleCount := d.policy.CountSelectingRulesLocked(e)
+		d.policy.Mutex.RUnlock()
+
+		workItems = append(workItems, regenWorkItem{
+			ep:                 e,
+			rev:                rev,
+			priority:           regenPriorityFor(e),
+			selectingRuleCount: selectingRuleCount,
+		})
 	})
-
 	enqueueWaitGroup.Wait()
 
+	if len(workItems) > 0 {
+		d.policyReactionQueue.run(workItems)
+	}
+
 	// Upsert new identities after regeneration has completed, if any. This makes sure the
 	// policy maps are ready to classify packets using the newly allocated identities before
 	// they are upserted to the ipcache here.
@@ -591,6 +675,7 @@ func (d *Daemon) policyDelete(labels labels.LabelArray, res chan interface{}) {
 		return
 	}
 	deletedRules.UpdateRulesEndpointsCaches(epsToBumpRevision, endpointsToRegen, &policySelectionWG)
+	d.policySources.removeSourceRules(deletedRules.AsPolicyRules())
 
 	res <- &PolicyDeleteResult{
 		newRev: rev,
@@ -647,6 +732,12 @@ func (d *Daemon) policyDelete(labels labels.LabelArray, res chan interface{}) {
 	if err := d.SendNotification(monitorAPI.PolicyDeleteMessage(deleted, labels.GetModel(), rev)); err != nil {
 		log.WithError(err).WithField(logfields.PolicyRevision, rev).Warn("Failed to send policy update as monitor notification")
 	}
+	d.recordPolicySnapshot(rev, "")
+	d.policyWatch.Publish(PolicyChangeEvent{
+		Revision:          rev,
+		DeletedLabels:     labels.GetModel(),
+		AffectedSelectors: ruleSelectors(deletedRules.AsPolicyRules()),
+	})
 
 	return
 }
@@ -661,6 +752,9 @@ func newDeletePolicyHandler(d *Daemon) DeletePolicyHandler {
 
 func (h *deletePolicy) Handle(params DeletePolicyParams) middleware.Responder {
 	d := h.daemon
+	if resp := d.requirePolicyRBAC(params.HTTPRequest, actionDeletePolicy, params.Labels); resp != nil {
+		return resp
+	}
 	lbls := labels.ParseSelectLabelArrayFromArray(params.Labels)
 	rev, err := d.PolicyDelete(lbls)
 	if err != nil {
@@ -701,6 +795,22 @@ func (h *putPolicy) Handle(params PutPolicyParams) middleware.Responder {
 		}
 	}
 
+	ruleSelectors := make([]string, 0, len(rules))
+	for _, r := range rules {
+		ruleSelectors = append(ruleSelectors, r.Labels.String())
+	}
+	if resp := d.requirePolicyRBAC(params.HTTPRequest, actionPutPolicy, ruleSelectors); resp != nil {
+		metrics.PolicyChangeTotal.WithLabelValues(metrics.LabelValueOutcomeFail).Inc()
+		return resp
+	}
+
+	mutatedRules, warnings, err := d.policyAdmission.Run(params.HTTPRequest.Context(), rules)
+	if err != nil {
+		metrics.PolicyChangeTotal.WithLabelValues(metrics.LabelValueOutcomeFail).Inc()
+		return api.Error(PutPolicyFailureCode, err)
+	}
+	rules = mutatedRules
+
 	rev, err := d.PolicyAdd(rules, &policy.AddOptions{Source: metrics.LabelEventSourceAPI})
 	if err != nil {
 		metrics.PolicyImportErrorsTotal.Inc() // Deprecated in Cilium 1.14, to be removed in 1.15.
@@ -712,19 +822,25 @@ func (h *putPolicy) Handle(params PutPolicyParams) middleware.Responder {
 	policy := &models.Policy{
 		Revision: int64(rev),
 		Policy:   policy.JSONMarshalRules(rules),
+		Warnings: warnings,
 	}
 	return NewPutPolicyOK().WithPayload(policy)
 }
 
 type getPolicy struct {
-	repo *policy.Repository
+	daemon *Daemon
+	repo   *policy.Repository
 }
 
-func newGetPolicyHandler(r *policy.Repository) GetPolicyHandler {
-	return &getPolicy{repo: r}
+func newGetPolicyHandler(d *Daemon, r *policy.Repository) GetPolicyHandler {
+	return &getPolicy{daemon: d, repo: r}
 }
 
 func (h *getPolicy) Handle(params GetPolicyParams) middleware.Responder {
+	if resp := h.daemon.requirePolicyRBAC(params.HTTPRequest, actionGetPolicy, params.Labels); resp != nil {
+		return resp
+	}
+
 	repository := h.repo
 	repository.Mutex.RLock()
 	defer repository.Mutex.RUnlock()
@@ -754,5 +870,8 @@ func newGetPolicyCacheHandler(d *Daemon) GetPolicySelectorsHandler {
 }
 
 func (h *getPolicySelectors) Handle(params GetPolicySelectorsParams) middleware.Responder {
+	if resp := h.daemon.requirePolicyRBAC(params.HTTPRequest, actionGetSelectors, nil); resp != nil {
+		return resp
+	}
 	return NewGetPolicySelectorsOK().WithPayload(h.daemon.policy.GetSelectorCache().GetModel())
 }
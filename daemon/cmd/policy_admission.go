@@ -0,0 +1,169 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/cilium/cilium/pkg/logging/logfields"
+	"github.com/cilium/cilium/pkg/policy"
+	policyAPI "github.com/cilium/cilium/pkg/policy/api"
+)
+
+// policyValidator is implemented by in-process validators registered via
+// hive, as well as by the webhook adapter constructed from
+// option.Config.PolicyAdmissionWebhooks. A validator may reject a rule, mutate it, or
+// append warnings to be surfaced in the PUT response. It returns the rule
+// set to pass to the next validator in the chain: mutatedRules is nil if
+// the validator made no changes, in which case the caller keeps using the
+// rules it was passed.
+type policyValidator interface {
+	Name() string
+	Validate(ctx context.Context, rules policyAPI.Rules) (mutatedRules policyAPI.Rules, warnings []string, err error)
+}
+
+// policyAdmissionChain runs every registered policyValidator, in
+// registration order, before a rule set is handed to policyAdd.
+type policyAdmissionChain struct {
+	validators []policyValidator
+}
+
+func newPolicyAdmissionChain() *policyAdmissionChain {
+	return &policyAdmissionChain{}
+}
+
+// Register adds v to the end of the chain. Intended to be called from hive
+// lifecycle hooks of in-process validator cells.
+func (c *policyAdmissionChain) Register(v policyValidator) {
+	c.validators = append(c.validators, v)
+}
+
+// Run invokes every registered validator in order, stopping at the first
+// rejection, threading each validator's mutated rule set into the next so
+// that e.g. a defaulting validator's changes are visible to the validator
+// run after it and are reflected in what's ultimately committed by
+// policyAdd. It returns the final rule set (mutated or, if no validator
+// changed anything, the original) along with the accumulated warnings from
+// validators that ran before any rejection.
+func (c *policyAdmissionChain) Run(ctx context.Context, rules policyAPI.Rules) (mutatedRules policyAPI.Rules, warnings []string, err error) {
+	current := rules
+	for _, v := range c.validators {
+		mutated, w, err := v.Validate(ctx, current)
+		warnings = append(warnings, w...)
+		if err != nil {
+			return current, warnings, fmt.Errorf("policy rejected by admission validator %q: %w", v.Name(), err)
+		}
+		if mutated != nil {
+			current = mutated
+		}
+	}
+	return current, warnings, nil
+}
+
+// webhookValidator adapts a single policy.AdmissionWebhookConfig to the
+// policyValidator interface, doing a JSON HTTP callout for the subset of
+// rules that match its selector. The response body is decoded into
+// webhookResponse; it is not validated against a JSON schema.
+type webhookValidator struct {
+	cfg    policy.AdmissionWebhookConfig
+	client *http.Client
+}
+
+func newWebhookValidator(cfg policy.AdmissionWebhookConfig) *webhookValidator {
+	return &webhookValidator{cfg: cfg, client: &http.Client{Timeout: cfg.Timeout}}
+}
+
+func (w *webhookValidator) Name() string { return w.cfg.Name }
+
+func (w *webhookValidator) Validate(ctx context.Context, rules policyAPI.Rules) (policyAPI.Rules, []string, error) {
+	var scopedIdx []int
+	var scoped policyAPI.Rules
+	for i, r := range rules {
+		if len(w.cfg.Selector) == 0 || labelsMatch(w.cfg.Selector, r.Labels) {
+			scopedIdx = append(scopedIdx, i)
+			scoped = append(scoped, r)
+		}
+	}
+	if len(scoped) == 0 {
+		return nil, nil, nil
+	}
+
+	resp, err := w.post(ctx, scoped)
+	if err != nil {
+		if w.cfg.FailurePolicy == policy.AdmissionFailClosed {
+			return nil, nil, fmt.Errorf("admission webhook %q unreachable and failure policy is fail-closed: %w", w.cfg.Name, err)
+		}
+		log.WithError(err).WithField(logfields.Webhook, w.cfg.Name).
+			Warn("Policy admission webhook unreachable, allowing rule through (fail-open)")
+		return nil, nil, nil
+	}
+	if err := resp.asError(); err != nil {
+		return nil, resp.Warnings, err
+	}
+
+	if len(resp.Rules) != len(scoped) {
+		// The webhook didn't return a mutated rule set of its own, or
+		// returned a malformed one; pass rules through unchanged rather
+		// than risk splicing a mismatched rule into the wrong slot.
+		return nil, resp.Warnings, nil
+	}
+	mutated := make(policyAPI.Rules, len(rules))
+	copy(mutated, rules)
+	for i, idx := range scopedIdx {
+		mutated[idx] = resp.Rules[i]
+	}
+	return mutated, resp.Warnings, nil
+}
+
+// webhookResponse is the expected JSON body of a policy.AdmissionWebhookConfig
+// response.
+type webhookResponse struct {
+	Allowed  bool            `json:"allowed"`
+	Reason   string          `json:"reason,omitempty"`
+	Warnings []string        `json:"warnings,omitempty"`
+	Rules    policyAPI.Rules `json:"rules,omitempty"` // the (possibly mutated) rules this webhook was sent, echoed back
+}
+
+func (r *webhookResponse) asError() error {
+	if r.Allowed {
+		return nil
+	}
+	if r.Reason == "" {
+		r.Reason = "rejected by admission webhook"
+	}
+	return fmt.Errorf("%s", r.Reason)
+}
+
+func (w *webhookValidator) post(ctx context.Context, rules policyAPI.Rules) (*webhookResponse, error) {
+	body, err := json.Marshal(rules)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("admission webhook returned status %d", resp.StatusCode)
+	}
+
+	var out webhookResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("malformed admission webhook response: %w", err)
+	}
+	return &out, nil
+}
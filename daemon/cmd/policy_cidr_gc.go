@@ -0,0 +1,119 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package cmd
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/cilium/cilium/pkg/logging/logfields"
+	"github.com/cilium/cilium/pkg/option"
+)
+
+// cidrReleaseGC defers the release of CIDR identities referenced by deleted
+// or replaced rules by CIDRIdentityGCGracePeriod, instead of releasing them
+// immediately. This avoids spurious drops and BPF map churn when a rule is
+// deleted and re-added for the same prefix within a short window, e.g. by a
+// GitOps reconciler doing a delete-then-recreate.
+type cidrReleaseGC struct {
+	mu      sync.Mutex
+	pending map[netip.Prefix]time.Time    // prefix -> time at which it becomes eligible for release
+	release func(prefixes []netip.Prefix) // releases prefixes from the ipcache immediately
+}
+
+func newCIDRReleaseGC(release func(prefixes []netip.Prefix)) *cidrReleaseGC {
+	return &cidrReleaseGC{
+		pending: make(map[netip.Prefix]time.Time),
+		release: release,
+	}
+}
+
+// scheduleRelease schedules prefixes for release after the configured grace
+// period, overwriting any earlier pending deadline for the same prefix. If
+// no grace period is configured, prefixes are released immediately instead
+// of being silently dropped, preserving the pre-deferred-release behavior
+// of always releasing unused CIDR identities.
+func (gc *cidrReleaseGC) scheduleRelease(prefixes []netip.Prefix) {
+	if option.Config.CIDRIdentityGCGracePeriod <= 0 {
+		gc.release(prefixes)
+		return
+	}
+	deadline := time.Now().Add(option.Config.CIDRIdentityGCGracePeriod)
+
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	for _, p := range prefixes {
+		gc.pending[p] = deadline
+	}
+}
+
+// cancel removes prefixes from the pending-release table, e.g. because a
+// PolicyAdd referencing them raced with their scheduled release. It returns
+// the subset of prefixes that were actually pending, so the caller can
+// reuse their identities instead of re-allocating.
+func (gc *cidrReleaseGC) cancel(prefixes []netip.Prefix) []netip.Prefix {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	var reused []netip.Prefix
+	for _, p := range prefixes {
+		if _, ok := gc.pending[p]; ok {
+			delete(gc.pending, p)
+			reused = append(reused, p)
+		}
+	}
+	return reused
+}
+
+// sweepExpired removes and returns every prefix whose grace period has
+// elapsed as of now.
+func (gc *cidrReleaseGC) sweepExpired(now time.Time) []netip.Prefix {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	var expired []netip.Prefix
+	for p, deadline := range gc.pending {
+		if !now.Before(deadline) {
+			expired = append(expired, p)
+			delete(gc.pending, p)
+		}
+	}
+	return expired
+}
+
+// startCIDRReleaseGC runs until ctx is cancelled, periodically releasing
+// CIDR identities whose grace period has elapsed. It is started from
+// initPolicy alongside the other policy background workers. When no grace
+// period is configured there is nothing to sweep: scheduleRelease already
+// releases prefixes immediately in that case instead of queuing them here.
+func (d *Daemon) startCIDRReleaseGC(ctx context.Context) {
+	if option.Config.CIDRIdentityGCGracePeriod <= 0 {
+		return
+	}
+
+	// A quarter of the grace period gives reasonably prompt cleanup
+	// without polling excessively for long grace periods.
+	interval := option.Config.CIDRIdentityGCGracePeriod / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				if expired := d.cidrReleaseGC.sweepExpired(now); len(expired) > 0 {
+					log.WithField(logfields.IPAddr, expired).Debug("Releasing CIDR identities after GC grace period")
+					d.ipcache.ReleaseCIDRIdentitiesByCIDR(expired)
+				}
+			}
+		}
+	}()
+}
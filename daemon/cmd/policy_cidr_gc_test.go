@@ -0,0 +1,65 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package cmd
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cilium/cilium/pkg/option"
+)
+
+func TestCIDRReleaseGCScheduleAndSweep(t *testing.T) {
+	old := option.Config.CIDRIdentityGCGracePeriod
+	option.Config.CIDRIdentityGCGracePeriod = time.Minute
+	defer func() { option.Config.CIDRIdentityGCGracePeriod = old }()
+
+	var released []netip.Prefix
+	gc := newCIDRReleaseGC(func(prefixes []netip.Prefix) { released = append(released, prefixes...) })
+
+	p := netip.MustParsePrefix("10.0.0.0/24")
+	now := time.Now()
+	gc.scheduleRelease([]netip.Prefix{p})
+
+	require.Empty(t, gc.sweepExpired(now), "grace period hasn't elapsed yet")
+	require.Empty(t, released)
+
+	expired := gc.sweepExpired(now.Add(2 * time.Minute))
+	require.Equal(t, []netip.Prefix{p}, expired)
+}
+
+func TestCIDRReleaseGCCancelReturnsReused(t *testing.T) {
+	old := option.Config.CIDRIdentityGCGracePeriod
+	option.Config.CIDRIdentityGCGracePeriod = time.Minute
+	defer func() { option.Config.CIDRIdentityGCGracePeriod = old }()
+
+	gc := newCIDRReleaseGC(func([]netip.Prefix) {})
+
+	p := netip.MustParsePrefix("10.0.0.0/24")
+	gc.scheduleRelease([]netip.Prefix{p})
+
+	reused := gc.cancel([]netip.Prefix{p})
+	require.Equal(t, []netip.Prefix{p}, reused)
+
+	// Already cancelled: a second cancel for the same prefix finds nothing
+	// pending.
+	require.Empty(t, gc.cancel([]netip.Prefix{p}))
+}
+
+func TestCIDRReleaseGCNoGracePeriodReleasesImmediately(t *testing.T) {
+	old := option.Config.CIDRIdentityGCGracePeriod
+	option.Config.CIDRIdentityGCGracePeriod = 0
+	defer func() { option.Config.CIDRIdentityGCGracePeriod = old }()
+
+	var released []netip.Prefix
+	gc := newCIDRReleaseGC(func(prefixes []netip.Prefix) { released = append(released, prefixes...) })
+
+	p := netip.MustParsePrefix("10.0.0.0/24")
+	gc.scheduleRelease([]netip.Prefix{p})
+
+	require.Equal(t, []netip.Prefix{p}, released)
+}
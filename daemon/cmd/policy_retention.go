@@ -0,0 +1,227 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package cmd
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-openapi/runtime/middleware"
+
+	"github.com/cilium/cilium/api/v1/models"
+	. "github.com/cilium/cilium/api/v1/server/restapi/policy"
+	"github.com/cilium/cilium/pkg/api"
+	"github.com/cilium/cilium/pkg/labels"
+	"github.com/cilium/cilium/pkg/logging/logfields"
+	"github.com/cilium/cilium/pkg/policy"
+	policyAPI "github.com/cilium/cilium/pkg/policy/api"
+)
+
+// policyRevisionSnapshot is a point-in-time record of the full rule set
+// present in the repository immediately after a mutation, together with
+// the revision the mutation produced and who/what caused it.
+type policyRevisionSnapshot struct {
+	Revision  uint64
+	Timestamp time.Time
+	Source    string
+	Rules     policyAPI.Rules // full rule set as of Revision
+}
+
+// policyRetentionConfig bounds how many snapshots are kept.
+type policyRetentionConfig struct {
+	MaxRevisions int
+	MaxAge       time.Duration
+}
+
+// policyRetentionStore keeps a bounded history of policy.Repository
+// snapshots so that a past revision can be inspected or rolled back to.
+type policyRetentionStore struct {
+	mu        sync.Mutex
+	snapshots []policyRevisionSnapshot
+	cfg       policyRetentionConfig
+}
+
+func newPolicyRetentionStore(cfg policyRetentionConfig) *policyRetentionStore {
+	return &policyRetentionStore{cfg: cfg}
+}
+
+// record appends a snapshot and then prunes according to cfg. Ruleset is
+// expected to be the full set of rules in the repository as of revision,
+// i.e. the result of repository.SearchRLocked(labels.LabelArray{}).
+func (s *policyRetentionStore) record(revision uint64, source string, ruleset policyAPI.Rules) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.snapshots = append(s.snapshots, policyRevisionSnapshot{
+		Revision:  revision,
+		Timestamp: time.Now(),
+		Source:    source,
+		Rules:     ruleset,
+	})
+	s.prune()
+}
+
+func (s *policyRetentionStore) prune() {
+	if s.cfg.MaxAge > 0 {
+		cutoff := time.Now().Add(-s.cfg.MaxAge)
+		i := 0
+		for i < len(s.snapshots) && s.snapshots[i].Timestamp.Before(cutoff) {
+			i++
+		}
+		s.snapshots = s.snapshots[i:]
+	}
+	if s.cfg.MaxRevisions > 0 && len(s.snapshots) > s.cfg.MaxRevisions {
+		s.snapshots = s.snapshots[len(s.snapshots)-s.cfg.MaxRevisions:]
+	}
+}
+
+func (s *policyRetentionStore) list() []policyRevisionSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]policyRevisionSnapshot, len(s.snapshots))
+	copy(out, s.snapshots)
+	return out
+}
+
+func (s *policyRetentionStore) get(rev uint64) (policyRevisionSnapshot, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, snap := range s.snapshots {
+		if snap.Revision == rev {
+			return snap, true
+		}
+	}
+	return policyRevisionSnapshot{}, false
+}
+
+func (s *policyRetentionStore) deleteBefore(t time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := 0
+	for i < len(s.snapshots) && s.snapshots[i].Timestamp.Before(t) {
+		i++
+	}
+	removed := i
+	s.snapshots = s.snapshots[i:]
+	return removed
+}
+
+// recordPolicySnapshot is called after every successful PolicyAdd/PolicyDelete
+// commit to snapshot the resulting repository state.
+func (d *Daemon) recordPolicySnapshot(rev uint64, source string) {
+	d.policy.Mutex.RLock()
+	ruleset := d.policy.SearchRLocked(labels.LabelArray{})
+	d.policy.Mutex.RUnlock()
+
+	d.policyRetention.record(rev, source, ruleset)
+}
+
+// RollbackPolicyTo replaces the current policy repository contents with the
+// rule set recorded at rev. The clear-then-restore is staged and committed
+// as a single policy transaction so that, unlike a bare PolicyDelete
+// followed by a PolicyAdd, no endpoint ever observes an intermediate state
+// with no policy loaded between the two.
+func (d *Daemon) RollbackPolicyTo(rev uint64) (newRev uint64, err error) {
+	snap, ok := d.policyRetention.get(rev)
+	if !ok {
+		return 0, fmt.Errorf("no retained policy revision %d", rev)
+	}
+
+	txn := d.BeginPolicyTxn()
+
+	if err := d.StageDelete(txn, labels.LabelArray{}); err != nil {
+		d.AbortPolicyTxn(txn)
+		return 0, fmt.Errorf("failed to stage clearing current policy before rollback: %w", err)
+	}
+
+	if err := d.StageRules(txn, snap.Rules, &policy.AddOptions{
+		Source:    fmt.Sprintf("rollback-to-%d", rev),
+		Generated: true,
+	}); err != nil {
+		d.AbortPolicyTxn(txn)
+		return 0, fmt.Errorf("failed to stage restored rules for rollback: %w", err)
+	}
+
+	newRev, err = d.CommitPolicyTxn(txn)
+	if err != nil {
+		return 0, fmt.Errorf("failed to commit rollback transaction: %w", err)
+	}
+	return newRev, nil
+}
+
+type getPolicyRevisions struct {
+	daemon *Daemon
+}
+
+func newGetPolicyRevisionsHandler(d *Daemon) GetPolicyRevisionsHandler {
+	return &getPolicyRevisions{daemon: d}
+}
+
+func (h *getPolicyRevisions) Handle(params GetPolicyRevisionsParams) middleware.Responder {
+	snaps := h.daemon.policyRetention.list()
+	payload := make([]*models.PolicyRevisionSummary, 0, len(snaps))
+	for _, s := range snaps {
+		payload = append(payload, &models.PolicyRevisionSummary{
+			Revision:  int64(s.Revision),
+			Source:    s.Source,
+			Timestamp: s.Timestamp.Format(time.RFC3339),
+		})
+	}
+	return NewGetPolicyRevisionsOK().WithPayload(payload)
+}
+
+type getPolicyRevision struct {
+	daemon *Daemon
+}
+
+func newGetPolicyRevisionHandler(d *Daemon) GetPolicyRevisionHandler {
+	return &getPolicyRevision{daemon: d}
+}
+
+func (h *getPolicyRevision) Handle(params GetPolicyRevisionParams) middleware.Responder {
+	snap, ok := h.daemon.policyRetention.get(uint64(params.Rev))
+	if !ok {
+		return NewGetPolicyRevisionNotFound()
+	}
+	return NewGetPolicyRevisionOK().WithPayload(&models.Policy{
+		Revision: int64(snap.Revision),
+		Policy:   policy.JSONMarshalRules(snap.Rules),
+	})
+}
+
+type postPolicyRevisionRollback struct {
+	daemon *Daemon
+}
+
+func newPostPolicyRevisionRollbackHandler(d *Daemon) PostPolicyRevisionRollbackHandler {
+	return &postPolicyRevisionRollback{daemon: d}
+}
+
+func (h *postPolicyRevisionRollback) Handle(params PostPolicyRevisionRollbackParams) middleware.Responder {
+	rev, err := h.daemon.RollbackPolicyTo(uint64(params.Rev))
+	if err != nil {
+		return api.Error(PostPolicyRevisionRollbackFailureCode, err)
+	}
+	log.WithField(logfields.PolicyRevision, rev).Info("Rolled back policy to a previous revision")
+	return NewPostPolicyRevisionRollbackOK().WithPayload(int64(rev))
+}
+
+type deletePolicyRevisions struct {
+	daemon *Daemon
+}
+
+func newDeletePolicyRevisionsHandler(d *Daemon) DeletePolicyRevisionsHandler {
+	return &deletePolicyRevisions{daemon: d}
+}
+
+func (h *deletePolicyRevisions) Handle(params DeletePolicyRevisionsParams) middleware.Responder {
+	before, err := time.Parse(time.RFC3339, params.Before)
+	if err != nil {
+		return api.Error(DeletePolicyRevisionsInvalidTimestampCode, err)
+	}
+	removed := h.daemon.policyRetention.deleteBefore(before)
+	log.WithField("removed", removed).Info("Pruned retained policy revisions")
+	return NewDeletePolicyRevisionsOK()
+}
@@ -0,0 +1,319 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/go-openapi/runtime/middleware"
+
+	"github.com/cilium/cilium/api/v1/models"
+	. "github.com/cilium/cilium/api/v1/server/restapi/policy"
+	"github.com/cilium/cilium/pkg/api"
+	"github.com/cilium/cilium/pkg/labels"
+	policyAPI "github.com/cilium/cilium/pkg/policy/api"
+)
+
+// policySourceScope restricts a registered policy source to a subset of the
+// cluster, e.g. a particular namespace label selector. An empty scope
+// matches everything.
+type policySourceScope struct {
+	LabelSelector labels.LabelArray
+}
+
+// registeredPolicySource is a named policy source registered via
+// RegisterPolicySource, along with its precedence and scope.
+type registeredPolicySource struct {
+	name     string
+	priority int // higher wins on conflict
+	scope    policySourceScope
+}
+
+// effectiveChangeSubscriber is notified only when the merged, effective
+// policy for labels actually changes, rather than on every source
+// add/delete regardless of whether it touched that scope.
+type effectiveChangeSubscriber struct {
+	labels labels.LabelArray
+	ch     chan struct{}
+}
+
+// policySourceRegistry tracks the policy sources registered with the
+// Daemon and the rules each of them has most recently contributed, so that
+// an effective, merged policy per set of endpoint labels can be computed on
+// demand by GetEffectivePolicy.
+type policySourceRegistry struct {
+	mu      sync.RWMutex
+	sources map[string]*registeredPolicySource
+	// rules maps source name -> label key (rule.Labels.String()) -> the
+	// rule currently contributed by that source under that label key. A
+	// second add under the same source only overwrites the entries for
+	// the label keys it resubmits, so earlier contributions under other
+	// label keys from that source are never silently forgotten.
+	rules map[string]map[string]policyAPI.Rule
+
+	// effectiveCache memoizes the merged result for a scope key until the
+	// next source change invalidates it.
+	effectiveCache map[string]*models.PolicyEffective
+
+	subscribers []effectiveChangeSubscriber
+}
+
+func newPolicySourceRegistry() *policySourceRegistry {
+	return &policySourceRegistry{
+		sources:        make(map[string]*registeredPolicySource),
+		rules:          make(map[string]map[string]policyAPI.Rule),
+		effectiveCache: make(map[string]*models.PolicyEffective),
+	}
+}
+
+// RegisterPolicySource registers a named policy source with the daemon.
+// Rules subsequently added via PolicyAdd with a matching AddOptions.Source
+// contribute to that source's layer when computing the effective policy for
+// a set of endpoint labels; PolicyDelete removes matching rules from every
+// source's layer.
+func (d *Daemon) RegisterPolicySource(name string, priority int, scope policySourceScope) error {
+	reg := d.policySources
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if _, exists := reg.sources[name]; exists {
+		return fmt.Errorf("policy source %q is already registered", name)
+	}
+	reg.sources[name] = &registeredPolicySource{name: name, priority: priority, scope: scope}
+	return nil
+}
+
+// SubscribeEffectiveChanges returns a channel that receives a (non-blocking,
+// best-effort) notification whenever a source add/delete actually changes
+// the merged effective policy for lbls, so callers such as endpoint
+// regeneration can react only to scopes that were really affected instead
+// of to every PolicyAdd/PolicyDelete regardless of whether it touched lbls.
+func (reg *policySourceRegistry) SubscribeEffectiveChanges(lbls labels.LabelArray) <-chan struct{} {
+	ch := make(chan struct{}, 1)
+	reg.mu.Lock()
+	reg.subscribers = append(reg.subscribers, effectiveChangeSubscriber{labels: lbls, ch: ch})
+	reg.mu.Unlock()
+	return ch
+}
+
+// recordSourceRules merges rules into the set currently attributed to
+// source, keyed by each rule's own label set, and invalidates the
+// effective-policy cache. It is called from policyAdd once an addition
+// carrying a known source has been committed to the repository.
+func (reg *policySourceRegistry) recordSourceRules(source string, rules policyAPI.Rules) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if _, ok := reg.sources[source]; !ok {
+		return
+	}
+
+	before := reg.snapshotSubscribedLocked()
+
+	set, ok := reg.rules[source]
+	if !ok {
+		set = make(map[string]policyAPI.Rule)
+		reg.rules[source] = set
+	}
+	for _, r := range rules {
+		set[r.Labels.String()] = r
+	}
+
+	reg.effectiveCache = make(map[string]*models.PolicyEffective)
+	reg.notifyChangedLocked(before)
+}
+
+// removeSourceRules prunes any currently-recorded source rule whose label
+// set matches one of deletedRules, regardless of which source originally
+// contributed it (policyDelete isn't source-scoped), and invalidates the
+// effective-policy cache. It is called from policyDelete once a label-array
+// deletion has been committed to the repository, so deleted rules don't
+// linger forever in GET /policy/effective.
+func (reg *policySourceRegistry) removeSourceRules(deletedRules policyAPI.Rules) {
+	if len(deletedRules) == 0 {
+		return
+	}
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	before := reg.snapshotSubscribedLocked()
+
+	for _, dr := range deletedRules {
+		key := dr.Labels.String()
+		for _, set := range reg.rules {
+			delete(set, key)
+		}
+	}
+
+	reg.effectiveCache = make(map[string]*models.PolicyEffective)
+	reg.notifyChangedLocked(before)
+}
+
+// snapshotSubscribedLocked computes the current effective policy for every
+// subscriber's scope, to be compared against the post-mutation result by
+// notifyChangedLocked. Callers must hold reg.mu for writing.
+func (reg *policySourceRegistry) snapshotSubscribedLocked() []*models.PolicyEffective {
+	before := make([]*models.PolicyEffective, len(reg.subscribers))
+	for i, sub := range reg.subscribers {
+		before[i] = reg.computeEffectiveLocked(sub.labels)
+	}
+	return before
+}
+
+// notifyChangedLocked recomputes each subscriber's scope and delivers a
+// best-effort notification to those whose result differs from before.
+// Callers must hold reg.mu for writing.
+func (reg *policySourceRegistry) notifyChangedLocked(before []*models.PolicyEffective) {
+	for i, sub := range reg.subscribers {
+		after := reg.computeEffectiveLocked(sub.labels)
+		if reflect.DeepEqual(before[i], after) {
+			continue
+		}
+		select {
+		case sub.ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// effectivePolicyFor merges the rules contributed by every registered
+// source matching lbls, in ascending priority order, recording which
+// source contributed each rule and which lower-priority source (if any) it
+// overrides by label. Rules from a higher-priority source are listed as
+// overriding any lower-priority rule carrying the same labels.
+func (reg *policySourceRegistry) effectivePolicyFor(lbls labels.LabelArray) *models.PolicyEffective {
+	key := labels.LabelArray(lbls).String()
+
+	reg.mu.RLock()
+	if cached, ok := reg.effectiveCache[key]; ok {
+		reg.mu.RUnlock()
+		return cached
+	}
+	reg.mu.RUnlock()
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if cached, ok := reg.effectiveCache[key]; ok {
+		return cached
+	}
+	result := reg.computeEffectiveLocked(lbls)
+	reg.effectiveCache[key] = result
+	return result
+}
+
+// computeEffectiveLocked computes the merged, effective policy for lbls
+// from the rules currently recorded for every source. Callers must hold
+// reg.mu (for reading or writing).
+func (reg *policySourceRegistry) computeEffectiveLocked(lbls labels.LabelArray) *models.PolicyEffective {
+	var ordered []*registeredPolicySource
+	for _, s := range reg.sources {
+		if len(s.scope.LabelSelector) == 0 || labelsMatch(s.scope.LabelSelector, lbls) {
+			ordered = append(ordered, s)
+		}
+	}
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i].priority < ordered[j].priority })
+
+	seenByLabel := make(map[string]string)          // rule label key -> source that currently owns it
+	winningRules := make(map[string]policyAPI.Rule) // rule label key -> the rule body currently winning
+	result := &models.PolicyEffective{}
+	for _, s := range ordered {
+		set := reg.rules[s.name]
+		keys := make([]string, 0, len(set))
+		for k := range set {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, lblKey := range keys {
+			r := set[lblKey]
+			if owner, ok := seenByLabel[lblKey]; ok {
+				result.Conflicts = append(result.Conflicts, &models.PolicyConflict{
+					Labels:           r.Labels.GetModel(),
+					OverriddenSource: owner,
+					WinningSource:    s.name,
+				})
+			}
+			seenByLabel[lblKey] = s.name
+			winningRules[lblKey] = r
+			result.Contributions = append(result.Contributions, &models.PolicySourceContribution{
+				Source: s.name,
+				Labels: r.Labels.GetModel(),
+			})
+		}
+	}
+
+	result.Rules = mergedRulesJSON(winningRules)
+
+	return result
+}
+
+// mergedRulesJSON renders the rule bodies in winningRules as a single JSON
+// array, in the same shape a PUT /policy or POST /policy/simulate request
+// body takes, ordered by label key for a deterministic result. This is the
+// merged policy itself, as distinct from Contributions/Conflicts, which
+// only describe where each rule came from and what it overrode.
+func mergedRulesJSON(winningRules map[string]policyAPI.Rule) string {
+	keys := make([]string, 0, len(winningRules))
+	for k := range winningRules {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	rules := make(policyAPI.Rules, 0, len(keys))
+	for _, k := range keys {
+		r := winningRules[k]
+		rules = append(rules, &r)
+	}
+
+	encoded, err := json.Marshal(rules)
+	if err != nil {
+		// Rule bodies are already validated by Sanitize before they ever
+		// reach recordSourceRules; a marshal failure here would mean a bug
+		// in that validation, not a recoverable runtime condition.
+		log.WithError(err).Error("Failed to marshal effective policy rules")
+		return "[]"
+	}
+	return string(encoded)
+}
+
+func labelsMatch(selector, lbls labels.LabelArray) bool {
+	for _, sl := range selector {
+		found := false
+		for _, l := range lbls {
+			if l.Key == sl.Key && l.Value == sl.Value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+type getPolicyEffective struct {
+	daemon *Daemon
+}
+
+func newGetPolicyEffectiveHandler(d *Daemon) GetPolicyEffectiveHandler {
+	return &getPolicyEffective{daemon: d}
+}
+
+// Handle implements GET /policy/effective?labels=..., returning the merged
+// view of every registered policy source's contribution for the requested
+// endpoint labels, along with which source won any conflicting rule.
+func (h *getPolicyEffective) Handle(params GetPolicyEffectiveParams) middleware.Responder {
+	lbls := labels.ParseSelectLabelArrayFromArray(params.Labels)
+	if len(lbls) == 0 {
+		return api.Error(GetPolicyEffectiveInvalidLabelsCode, fmt.Errorf("labels parameter is required"))
+	}
+
+	result := h.daemon.policySources.effectivePolicyFor(lbls)
+	return NewGetPolicyEffectiveOK().WithPayload(result)
+}
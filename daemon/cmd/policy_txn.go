@@ -0,0 +1,394 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/go-openapi/runtime/middleware"
+	"github.com/google/uuid"
+
+	. "github.com/cilium/cilium/api/v1/server/restapi/policy"
+	"github.com/cilium/cilium/pkg/api"
+	"github.com/cilium/cilium/pkg/eventqueue"
+	"github.com/cilium/cilium/pkg/identity"
+	"github.com/cilium/cilium/pkg/labels"
+	"github.com/cilium/cilium/pkg/logging/logfields"
+	"github.com/cilium/cilium/pkg/option"
+	"github.com/cilium/cilium/pkg/policy"
+	policyAPI "github.com/cilium/cilium/pkg/policy/api"
+)
+
+// TxnID identifies an in-flight policy transaction created by BeginPolicyTxn.
+type TxnID string
+
+// defaultPolicyTxnTTL bounds how long a transaction may stay open when
+// option.Config.PolicyTxnTTL is unset, so a client that begins a
+// transaction and then crashes or drops its connection before
+// committing/aborting cannot leak open transactions, CIDR refcounts, and
+// allocated identities forever.
+const defaultPolicyTxnTTL = 10 * time.Minute
+
+// policyTxn accumulates staged rule additions and deletions until it is
+// either committed or aborted. Staging never touches d.policy directly;
+// mutations are only applied to the repository at commit time, under a
+// single acquisition of d.policy.Mutex.
+type policyTxn struct {
+	id             TxnID
+	deadline       time.Time // BeginPolicyTxn time plus the configured TTL; swept by reapExpiredPolicyTxns
+	stagedAdds     []stagedAdd
+	stagedDels     []labels.LabelArray
+	prefixes       []netip.Prefix                      // CIDR prefixes reference-counted while staging, released on abort
+	allocatedIDs   []identity.NumericIdentity          // CIDR identities allocated while staging, released on abort
+	pendingUpserts map[netip.Prefix]*identity.Identity // newly allocated identities to upsert to the ipcache on commit
+}
+
+type stagedAdd struct {
+	rules policyAPI.Rules
+	opts  *policy.AddOptions
+}
+
+// policyTxnManager tracks the set of open transactions for a Daemon.
+type policyTxnManager struct {
+	mu   sync.Mutex
+	txns map[TxnID]*policyTxn
+}
+
+func newPolicyTxnManager() *policyTxnManager {
+	return &policyTxnManager{txns: make(map[TxnID]*policyTxn)}
+}
+
+// policyTxnTTL returns the configured transaction TTL, falling back to
+// defaultPolicyTxnTTL when unset.
+func policyTxnTTL() time.Duration {
+	if option.Config.PolicyTxnTTL > 0 {
+		return option.Config.PolicyTxnTTL
+	}
+	return defaultPolicyTxnTTL
+}
+
+// BeginPolicyTxn opens a new policy transaction and returns its ID. Rules
+// and deletions staged against this ID accumulate locally until
+// CommitPolicyTxn or AbortPolicyTxn is called, or until it is reaped after
+// policyTxnTTL as abandoned.
+func (d *Daemon) BeginPolicyTxn() TxnID {
+	id := TxnID(uuid.New().String())
+
+	d.policyTxns.mu.Lock()
+	defer d.policyTxns.mu.Unlock()
+	d.policyTxns.txns[id] = &policyTxn{
+		id:             id,
+		deadline:       time.Now().Add(policyTxnTTL()),
+		pendingUpserts: make(map[netip.Prefix]*identity.Identity),
+	}
+
+	return id
+}
+
+// expireTxns removes and returns every transaction whose deadline has
+// elapsed as of now, without touching the policy repository: an abandoned
+// transaction never reached CommitPolicyTxn, so there's nothing staged
+// against the repository to undo, only the speculative CIDR allocations
+// StageRules made to release.
+func (m *policyTxnManager) expireTxns(now time.Time) []*policyTxn {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var expired []*policyTxn
+	for id, t := range m.txns {
+		if !now.Before(t.deadline) {
+			expired = append(expired, t)
+			delete(m.txns, id)
+		}
+	}
+	return expired
+}
+
+// reapExpiredPolicyTxns runs until ctx is cancelled, periodically releasing
+// transactions that were begun but never committed or aborted within
+// policyTxnTTL. It is started from initPolicy alongside the other policy
+// background workers.
+func (d *Daemon) reapExpiredPolicyTxns(ctx context.Context) {
+	ttl := policyTxnTTL()
+	interval := ttl / 4
+	if interval < time.Minute {
+		interval = time.Minute
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				for _, t := range d.policyTxns.expireTxns(now) {
+					log.WithField(logfields.PolicyRevision, t.id).
+						Warn("Abandoned policy transaction exceeded its TTL, releasing staged CIDR allocations")
+					if len(t.allocatedIDs) > 0 {
+						d.ipcache.ReleaseCIDRIdentitiesByID(t.allocatedIDs)
+					}
+					if len(t.prefixes) > 0 {
+						d.prefixLengths.Delete(t.prefixes)
+					}
+				}
+			}
+		}
+	}()
+}
+
+// StageRules stages rules for addition under txn, to be applied atomically
+// when CommitPolicyTxn is called. It does not modify the policy repository,
+// but it does eagerly reference-count and allocate identities for any CIDR
+// prefixes the rules select, exactly as policyAdd does, so that a rule
+// committed later in the same transaction has an identity to enforce
+// against immediately. AbortPolicyTxn releases everything allocated here.
+func (d *Daemon) StageRules(txn TxnID, rules policyAPI.Rules, opts *policy.AddOptions) error {
+	d.policyTxns.mu.Lock()
+	defer d.policyTxns.mu.Unlock()
+
+	t, ok := d.policyTxns.txns[txn]
+	if !ok {
+		return fmt.Errorf("unknown policy transaction %q", txn)
+	}
+
+	prefixes := policy.GetCIDRPrefixes(rules)
+	if _, err := d.prefixLengths.Add(prefixes); err != nil {
+		return fmt.Errorf("failed to reference-count prefix lengths for staged CIDR policy: %w", err)
+	}
+
+	// As with policyAdd, cancel any pending deferred release for these
+	// prefixes so a transaction that restages a CIDR shortly after it was
+	// deleted reuses the existing identity instead of churning the BPF maps
+	// with a release followed immediately by a re-allocation.
+	d.cidrReleaseGC.cancel(prefixes)
+
+	newlyAllocated := make(map[netip.Prefix]*identity.Identity)
+	usedIdentities, err := d.ipcache.AllocateCIDRs(prefixes, nil, newlyAllocated)
+	if err != nil {
+		d.prefixLengths.Delete(prefixes)
+		return fmt.Errorf("failed to allocate identities for staged CIDRs: %w", err)
+	}
+
+	t.prefixes = append(t.prefixes, prefixes...)
+	for _, id := range usedIdentities {
+		t.allocatedIDs = append(t.allocatedIDs, id.ID)
+	}
+	for prefix, id := range newlyAllocated {
+		t.pendingUpserts[prefix] = id
+	}
+
+	t.stagedAdds = append(t.stagedAdds, stagedAdd{rules: rules, opts: opts})
+	return nil
+}
+
+// StageDelete stages a deletion by label under txn, to be applied atomically
+// when CommitPolicyTxn is called.
+func (d *Daemon) StageDelete(txn TxnID, lbls labels.LabelArray) error {
+	d.policyTxns.mu.Lock()
+	defer d.policyTxns.mu.Unlock()
+
+	t, ok := d.policyTxns.txns[txn]
+	if !ok {
+		return fmt.Errorf("unknown policy transaction %q", txn)
+	}
+	t.stagedDels = append(t.stagedDels, lbls)
+	return nil
+}
+
+// AbortPolicyTxn discards all rules and deletions staged under txn without
+// ever having applied them to the policy repository, and releases any CIDR
+// identities that were speculatively allocated while staging.
+func (d *Daemon) AbortPolicyTxn(txn TxnID) error {
+	d.policyTxns.mu.Lock()
+	t, ok := d.policyTxns.txns[txn]
+	delete(d.policyTxns.txns, txn)
+	d.policyTxns.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("unknown policy transaction %q", txn)
+	}
+
+	if len(t.allocatedIDs) > 0 {
+		d.ipcache.ReleaseCIDRIdentitiesByID(t.allocatedIDs)
+	}
+	if len(t.prefixes) > 0 {
+		d.prefixLengths.Delete(t.prefixes)
+	}
+	return nil
+}
+
+// CommitPolicyTxn applies every rule staged under txn to the policy
+// repository as a single logical change: the repository lock is taken once,
+// all staged deletions and additions are applied, and a single
+// PolicyReactionEvent carrying the union of affected endpoints is enqueued.
+// The repository revision still advances once per staged deletion and
+// addition, but no endpoint reacts to the intermediate revisions: this
+// avoids the N endpoint regeneration passes that N separate
+// PolicyAdd/PolicyDelete calls would otherwise produce.
+func (d *Daemon) CommitPolicyTxn(txn TxnID) (newRev uint64, err error) {
+	d.policyTxns.mu.Lock()
+	t, ok := d.policyTxns.txns[txn]
+	delete(d.policyTxns.txns, txn)
+	d.policyTxns.mu.Unlock()
+
+	if !ok {
+		return 0, fmt.Errorf("unknown policy transaction %q", txn)
+	}
+
+	logger := log.WithField(logfields.PolicyRevision, txn)
+
+	d.policy.Mutex.Lock()
+
+	var policySelectionWG sync.WaitGroup
+	allEndpoints := d.endpointManager.GetPolicyEndpoints()
+	endpointsToBumpRevision := policy.NewEndpointSet(allEndpoints)
+	endpointsToRegen := policy.NewEndpointSet(nil)
+
+	// removedPrefixes tracks CIDR prefixes referenced by rules this commit
+	// deletes or replaces, exactly as policyAdd/policyDelete do, so their
+	// refcounts and identities are released after the repository lock is
+	// dropped below instead of leaking.
+	var removedPrefixes []netip.Prefix
+
+	for _, del := range t.stagedDels {
+		deletedRules, _, _ := d.policy.DeleteByLabelsLocked(del)
+		removedPrefixes = append(removedPrefixes, policy.GetCIDRPrefixes(deletedRules.AsPolicyRules())...)
+		deletedRules.UpdateRulesEndpointsCaches(endpointsToBumpRevision, endpointsToRegen, &policySelectionWG)
+	}
+
+	// StageRules already cancelled any pending deferred release for
+	// t.prefixes as of staging time, but the commit can happen much later
+	// (up to policyTxnTTL): cancel again here, immediately before the rules
+	// are actually applied, in case another policyAdd/policyDelete/commit
+	// scheduled a release for one of them in the meantime.
+	if len(t.prefixes) > 0 {
+		d.cidrReleaseGC.cancel(t.prefixes)
+	}
+
+	for _, add := range t.stagedAdds {
+		if add.opts != nil && add.opts.Replace {
+			for _, r := range add.rules {
+				if oldRules := d.policy.SearchRLocked(r.Labels); len(oldRules) > 0 {
+					deletedRules, _, _ := d.policy.DeleteByLabelsLocked(r.Labels)
+					removedPrefixes = append(removedPrefixes, policy.GetCIDRPrefixes(deletedRules.AsPolicyRules())...)
+					deletedRules.UpdateRulesEndpointsCaches(endpointsToBumpRevision, endpointsToRegen, &policySelectionWG)
+				}
+			}
+		}
+		addedRules, rev := d.policy.AddListLocked(add.rules)
+		addedRules.UpdateRulesEndpointsCaches(endpointsToBumpRevision, endpointsToRegen, &policySelectionWG)
+		newRev = rev
+	}
+
+	d.policy.Mutex.Unlock()
+
+	// Refcounts have been incremented by StageRules for any CIDRs re-added
+	// in this same commit, so decrements here are no-ops for those and
+	// trigger release only for prefixes no longer used by anything.
+	if len(removedPrefixes) > 0 {
+		logger.WithField("prefixes", removedPrefixes).Debug("Decrementing replaced/deleted CIDR refcounts on policy transaction commit")
+		d.cidrReleaseGC.scheduleRelease(removedPrefixes)
+		d.prefixLengths.Delete(removedPrefixes)
+	}
+
+	logger.WithField(logfields.PolicyRevision, newRev).Info("Committed policy transaction")
+
+	r := &PolicyReactionEvent{
+		d:                 d,
+		wg:                &policySelectionWG,
+		epsToBumpRevision: endpointsToBumpRevision,
+		endpointsToRegen:  endpointsToRegen,
+		newRev:            newRev,
+		upsertIdentities:  t.pendingUpserts,
+	}
+	ev := eventqueue.NewEvent(r)
+	if _, err := d.policy.RuleReactionQueue.Enqueue(ev); err != nil {
+		logger.WithError(err).Error("enqueue of RuleReactionEvent failed for committed policy transaction")
+	}
+
+	return newRev, nil
+}
+
+type postPolicyTxn struct {
+	daemon *Daemon
+}
+
+func newPostPolicyTxnHandler(d *Daemon) PostPolicyTxnHandler {
+	return &postPolicyTxn{daemon: d}
+}
+
+// Handle implements POST /policy/txn: opens a new policy transaction and
+// returns its ID for use with subsequent stage/commit/abort calls.
+func (h *postPolicyTxn) Handle(params PostPolicyTxnParams) middleware.Responder {
+	return NewPostPolicyTxnCreated().WithPayload(string(h.daemon.BeginPolicyTxn()))
+}
+
+type putPolicyTxnRules struct {
+	daemon *Daemon
+}
+
+func newPutPolicyTxnRulesHandler(d *Daemon) PutPolicyTxnRulesHandler {
+	return &putPolicyTxnRules{daemon: d}
+}
+
+// Handle implements PUT /policy/txn/{id}/rules: stages a rule set against an
+// open transaction without touching the policy repository.
+func (h *putPolicyTxnRules) Handle(params PutPolicyTxnRulesParams) middleware.Responder {
+	var rules policyAPI.Rules
+	if err := json.Unmarshal([]byte(params.Policy), &rules); err != nil {
+		return NewPutPolicyTxnRulesInvalidPolicy()
+	}
+	for _, r := range rules {
+		if err := r.Sanitize(); err != nil {
+			return api.Error(PutPolicyTxnRulesFailureCode, err)
+		}
+	}
+
+	if err := h.daemon.StageRules(TxnID(params.ID), rules, &policy.AddOptions{Source: "txn"}); err != nil {
+		return api.Error(PutPolicyTxnRulesFailureCode, err)
+	}
+	return NewPutPolicyTxnRulesOK()
+}
+
+type postPolicyTxnCommit struct {
+	daemon *Daemon
+}
+
+func newPostPolicyTxnCommitHandler(d *Daemon) PostPolicyTxnCommitHandler {
+	return &postPolicyTxnCommit{daemon: d}
+}
+
+// Handle implements POST /policy/txn/{id}/commit: applies every rule and
+// deletion staged against the transaction atomically.
+func (h *postPolicyTxnCommit) Handle(params PostPolicyTxnCommitParams) middleware.Responder {
+	rev, err := h.daemon.CommitPolicyTxn(TxnID(params.ID))
+	if err != nil {
+		return api.Error(PostPolicyTxnCommitFailureCode, err)
+	}
+	return NewPostPolicyTxnCommitOK().WithPayload(int64(rev))
+}
+
+type postPolicyTxnAbort struct {
+	daemon *Daemon
+}
+
+func newPostPolicyTxnAbortHandler(d *Daemon) PostPolicyTxnAbortHandler {
+	return &postPolicyTxnAbort{daemon: d}
+}
+
+// Handle implements POST /policy/txn/{id}/abort: discards the transaction
+// and releases any CIDR identities allocated while staging it.
+func (h *postPolicyTxnAbort) Handle(params PostPolicyTxnAbortParams) middleware.Responder {
+	if err := h.daemon.AbortPolicyTxn(TxnID(params.ID)); err != nil {
+		return api.Error(PostPolicyTxnAbortFailureCode, err)
+	}
+	return NewPostPolicyTxnAbortOK()
+}
@@ -0,0 +1,33 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package cmd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicyTxnManagerExpireTxns(t *testing.T) {
+	m := newPolicyTxnManager()
+	now := time.Now()
+
+	m.txns["expired"] = &policyTxn{id: "expired", deadline: now.Add(-time.Minute)}
+	m.txns["live"] = &policyTxn{id: "live", deadline: now.Add(time.Hour)}
+
+	expired := m.expireTxns(now)
+
+	require.Len(t, expired, 1)
+	require.Equal(t, TxnID("expired"), expired[0].id)
+
+	_, stillThere := m.txns["live"]
+	require.True(t, stillThere)
+	_, expiredStillThere := m.txns["expired"]
+	require.False(t, expiredStillThere)
+}
+
+func TestPolicyTxnTTLDefault(t *testing.T) {
+	require.Equal(t, defaultPolicyTxnTTL, policyTxnTTL())
+}
@@ -0,0 +1,225 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package cmd
+
+import (
+	"encoding/json"
+	"net/netip"
+
+	"github.com/go-openapi/runtime/middleware"
+
+	"github.com/cilium/cilium/api/v1/models"
+	. "github.com/cilium/cilium/api/v1/server/restapi/policy"
+	"github.com/cilium/cilium/pkg/api"
+	"github.com/cilium/cilium/pkg/endpoint"
+	"github.com/cilium/cilium/pkg/labels"
+	"github.com/cilium/cilium/pkg/logging/logfields"
+	"github.com/cilium/cilium/pkg/policy"
+	policyAPI "github.com/cilium/cilium/pkg/policy/api"
+)
+
+// policyAddPlan is the outcome of computePolicyAddPlan: everything PolicyAdd
+// would do to the repository and to locally managed endpoints, without
+// actually doing it.
+type policyAddPlan struct {
+	// replacedLabels are the labels of existing rules that would be
+	// replaced by this add, one entry per Replace/ReplaceWithLabels match.
+	replacedLabels []labels.LabelArray
+
+	// regenEndpointIDs are the endpoints which would require a full
+	// datapath regeneration.
+	regenEndpointIDs []int64
+
+	// bumpEndpointIDs are the endpoints which would only need their
+	// policy revision bumped, without a regeneration.
+	bumpEndpointIDs []int64
+
+	// prefixes are the CIDR prefixes referenced by sourceRules.
+	prefixes []string
+
+	// mapChanges are the per-endpoint L3/L4 policy map entries sourceRules
+	// would add or remove, for endpoints it was possible to resolve this
+	// precisely for (see ResolveMapChanges' ok return).
+	mapChanges []endpointMapChanges
+}
+
+// endpointMapChanges is the added/removed BPF policy map entries
+// sourceRules would produce for a single endpoint, rendered the same way
+// simulatePolicyChange renders them.
+type endpointMapChanges struct {
+	endpointID int64
+	added      []string
+	removed    []string
+}
+
+// computePolicyAddPlan computes the effects of adding sourceRules to the
+// policy repository under the given opts, without mutating the repository,
+// allocating identities, or touching any endpoint. The Replace/
+// ReplaceWithLabels matching it runs is shared with the real PolicyAdd path
+// via rulesToReplace, so the two can never disagree about which existing
+// rules an add would replace.
+//
+// computePolicyAddPlan takes d.policy.Mutex for reading for the duration of
+// the computation; it is the caller's responsibility to serialize this with
+// any concurrent mutation of the repository if an exact answer is required.
+func (d *Daemon) computePolicyAddPlan(sourceRules policyAPI.Rules, opts *policy.AddOptions) *policyAddPlan {
+	plan := &policyAddPlan{
+		prefixes: ipsToStrings(policy.GetCIDRPrefixes(sourceRules)),
+	}
+
+	d.policy.Mutex.RLock()
+	defer d.policy.Mutex.RUnlock()
+
+	plan.replacedLabels = d.rulesToReplace(sourceRules, opts)
+
+	identities := d.identityAllocator.GetIdentityCache()
+
+	// sourceRules isn't actually inserted into the repository, so we can't
+	// run the real selector cache resolution; instead, match sourceRules'
+	// own EndpointSelectors against each locally managed endpoint's labels
+	// directly. An endpoint only needs a full regeneration if sourceRules
+	// select it; otherwise it only needs its policy revision bumped.
+	for _, ep := range d.endpointManager.GetPolicyEndpoints() {
+		e, ok := ep.(*endpoint.Endpoint)
+		if !ok || e == nil {
+			continue
+		}
+		if !rulesSelectEndpoint(sourceRules, e) {
+			plan.bumpEndpointIDs = append(plan.bumpEndpointIDs, int64(e.GetID()))
+			continue
+		}
+
+		plan.regenEndpointIDs = append(plan.regenEndpointIDs, int64(e.GetID()))
+
+		// ResolveMapChanges runs the same incremental resolution
+		// ApplyPolicyMapDelta would; reuse it here purely for reporting,
+		// without ever calling ApplyPolicyMapDelta itself. Endpoints whose
+		// selecting rules use a construct it can't diff precisely (deny
+		// rules, CIDR/entity peers, port ranges) are reported with no
+		// added/removed entries rather than a misleading partial list.
+		added, removed, ok := d.policy.ResolveMapChanges(e, sourceRules, identities)
+		if !ok {
+			continue
+		}
+		mc := endpointMapChanges{endpointID: int64(e.GetID())}
+		for _, a := range added {
+			mc.added = append(mc.added, mapChangeFilterString(a))
+		}
+		for _, r := range removed {
+			mc.removed = append(mc.removed, mapChangeFilterString(r))
+		}
+		if len(mc.added) > 0 || len(mc.removed) > 0 {
+			plan.mapChanges = append(plan.mapChanges, mc)
+		}
+	}
+
+	return plan
+}
+
+// rulesToReplace returns the label arrays of existing rules that adding
+// sourceRules under opts would replace, by running the exact same
+// Replace/ReplaceWithLabels matching as the real PolicyAdd path. Callers
+// must already hold d.policy.Mutex for at least reading.
+func (d *Daemon) rulesToReplace(sourceRules policyAPI.Rules, opts *policy.AddOptions) []labels.LabelArray {
+	var replaced []labels.LabelArray
+	if opts == nil {
+		return replaced
+	}
+	if opts.Replace {
+		for _, r := range sourceRules {
+			if oldRules := d.policy.SearchRLocked(r.Labels); len(oldRules) > 0 {
+				replaced = append(replaced, r.Labels)
+			}
+		}
+	}
+	if len(opts.ReplaceWithLabels) > 0 {
+		if oldRules := d.policy.SearchRLocked(opts.ReplaceWithLabels); len(oldRules) > 0 {
+			replaced = append(replaced, opts.ReplaceWithLabels)
+		}
+	}
+	return replaced
+}
+
+// rulesSelectEndpoint reports whether any of rules' EndpointSelector
+// matches e's current labels.
+func rulesSelectEndpoint(rules policyAPI.Rules, e *endpoint.Endpoint) bool {
+	epLabels := e.GetLabels()
+	for _, r := range rules {
+		if r.EndpointSelector.Matches(epLabels) {
+			return true
+		}
+	}
+	return false
+}
+
+func ipsToStrings(prefixes []netip.Prefix) []string {
+	out := make([]string, 0, len(prefixes))
+	for _, p := range prefixes {
+		out = append(out, p.String())
+	}
+	return out
+}
+
+type postPolicyValidate struct {
+	daemon *Daemon
+}
+
+func newPostPolicyValidateHandler(d *Daemon) PostPolicyValidateHandler {
+	return &postPolicyValidate{daemon: d}
+}
+
+// Handle implements POST /policy/validate. It runs the same rule parsing and
+// CIDR prefix accounting that PutPolicyHandler would, plus computePolicyAddPlan,
+// but never touches d.policy or any endpoint, so operators can preview the
+// blast radius of a CNP before applying it.
+func (h *postPolicyValidate) Handle(params PostPolicyValidateParams) middleware.Responder {
+	d := h.daemon
+
+	var rules policyAPI.Rules
+	if err := unmarshalPolicy(params.Policy, &rules); err != nil {
+		return NewPostPolicyValidateInvalidPolicy()
+	}
+
+	result := &models.PolicyValidateResult{}
+	for _, r := range rules {
+		if err := r.Sanitize(); err != nil {
+			result.ParseErrors = append(result.ParseErrors, err.Error())
+		}
+	}
+	if len(result.ParseErrors) > 0 {
+		return NewPostPolicyValidateOK().WithPayload(result)
+	}
+
+	plan := d.computePolicyAddPlan(rules, &policy.AddOptions{Source: "validate"})
+
+	for _, l := range plan.replacedLabels {
+		result.ReplacedRules = append(result.ReplacedRules, l.GetModel())
+	}
+	for _, id := range plan.regenEndpointIDs {
+		result.EndpointsRequiringRegeneration = append(result.EndpointsRequiringRegeneration, id)
+	}
+	for _, id := range plan.bumpEndpointIDs {
+		result.EndpointsRequiringRevisionBump = append(result.EndpointsRequiringRevisionBump, id)
+	}
+	result.Prefixes = plan.prefixes
+	for _, mc := range plan.mapChanges {
+		result.EndpointMapChanges = append(result.EndpointMapChanges, &models.PolicyValidateEndpointMapChanges{
+			EndpointID:     mc.endpointID,
+			AddedEntries:   mc.added,
+			RemovedEntries: mc.removed,
+		})
+	}
+
+	log.WithField(logfields.Count, len(rules)).Debug("POST /policy/validate request")
+
+	return NewPostPolicyValidateOK().WithPayload(result)
+}
+
+// unmarshalPolicy parses a policy payload the same way putPolicy.Handle does.
+func unmarshalPolicy(payload string, rules *policyAPI.Rules) error {
+	if err := json.Unmarshal([]byte(payload), rules); err != nil {
+		return api.Error(PutPolicyFailureCode, err)
+	}
+	return nil
+}
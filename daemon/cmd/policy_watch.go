@@ -0,0 +1,142 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/go-openapi/runtime"
+	"github.com/go-openapi/runtime/middleware"
+
+	. "github.com/cilium/cilium/api/v1/server/restapi/policy"
+	"github.com/cilium/cilium/pkg/api"
+)
+
+// PolicyChangeEvent is emitted on every completed PolicyAdd/PolicyDelete and
+// delivered to GET /policy/watch subscribers, in addition to the existing
+// monitor PolicyUpdateMessage/PolicyDeleteMessage broadcast.
+type PolicyChangeEvent struct {
+	Revision          uint64   `json:"revision"`
+	Source            string   `json:"source"`
+	AddedLabels       []string `json:"addedLabels,omitempty"`
+	DeletedLabels     []string `json:"deletedLabels,omitempty"`
+	AffectedSelectors []string `json:"affectedSelectors,omitempty"`
+}
+
+// policyWatchBroker fans out PolicyChangeEvents to every active
+// GET /policy/watch subscriber, and keeps enough history for a subscriber
+// reconnecting with ?since=<rev> to replay what it missed.
+type policyWatchBroker struct {
+	mu          sync.Mutex
+	subscribers map[chan PolicyChangeEvent]struct{}
+	history     []PolicyChangeEvent // bounded replay buffer, oldest first
+	maxHistory  int
+}
+
+func newPolicyWatchBroker() *policyWatchBroker {
+	return &policyWatchBroker{
+		subscribers: make(map[chan PolicyChangeEvent]struct{}),
+		maxHistory:  1024,
+	}
+}
+
+// Publish records ev and delivers it to every currently subscribed channel,
+// dropping it for any subscriber whose channel is full rather than
+// blocking the policy Add/Delete path.
+func (b *policyWatchBroker) Publish(ev PolicyChangeEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.history = append(b.history, ev)
+	if len(b.history) > b.maxHistory {
+		b.history = b.history[len(b.history)-b.maxHistory:]
+	}
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// Subscribe registers a new subscriber and returns its channel along with
+// every retained event with a revision greater than since, which the caller
+// should replay before forwarding further live events. Call unsubscribe
+// when the caller's connection closes.
+func (b *policyWatchBroker) Subscribe(since uint64) (ch chan PolicyChangeEvent, replay []PolicyChangeEvent, unsubscribe func()) {
+	ch = make(chan PolicyChangeEvent, 64)
+
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	for _, ev := range b.history {
+		if ev.Revision > since {
+			replay = append(replay, ev)
+		}
+	}
+	b.mu.Unlock()
+
+	unsubscribe = func() {
+		b.mu.Lock()
+		delete(b.subscribers, ch)
+		b.mu.Unlock()
+	}
+	return ch, replay, unsubscribe
+}
+
+type getPolicyWatch struct {
+	daemon *Daemon
+}
+
+func newGetPolicyWatchHandler(d *Daemon) GetPolicyWatchHandler {
+	return &getPolicyWatch{daemon: d}
+}
+
+// Handle implements GET /policy/watch: a chunked-JSON streaming endpoint
+// that emits a PolicyChangeEvent per line for every policy change, starting
+// with a replay of any retained events since params.Since.
+func (h *getPolicyWatch) Handle(params GetPolicyWatchParams) middleware.Responder {
+	var since uint64
+	if params.Since != nil {
+		since = uint64(*params.Since)
+	}
+	ctx := params.HTTPRequest.Context()
+
+	return middleware.ResponderFunc(func(w http.ResponseWriter, _ runtime.Producer) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			api.Error(http.StatusInternalServerError, fmt.Errorf("streaming unsupported")).WriteResponse(w, nil)
+			return
+		}
+
+		ch, replay, unsubscribe := h.daemon.policyWatch.Subscribe(since)
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "application/json; boundary=NL")
+		w.WriteHeader(http.StatusOK)
+
+		enc := json.NewEncoder(w)
+		for _, ev := range replay {
+			if err := enc.Encode(ev); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+
+		for {
+			select {
+			case ev := <-ch:
+				if err := enc.Encode(ev); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,185 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package cmd
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/cilium/cilium/pkg/endpoint"
+	"github.com/cilium/cilium/pkg/endpoint/regeneration"
+	"github.com/cilium/cilium/pkg/logging/logfields"
+	"github.com/cilium/cilium/pkg/metrics"
+	"github.com/cilium/cilium/pkg/option"
+)
+
+// endpointRegenPriority orders endpoints competing for a slot in the bounded
+// regeneration worker pool. Lower values are serviced first.
+type endpointRegenPriority int
+
+const (
+	priorityHostEndpoint endpointRegenPriority = iota
+	priorityInitEndpoint
+	priorityPodEndpoint
+)
+
+// regenWorkItem is the unit of work placed on the policy reaction
+// workqueue: an endpoint to regenerate, along with the policy revision the
+// regeneration is reacting to.
+type regenWorkItem struct {
+	ep                 *endpoint.Endpoint
+	rev                uint64
+	priority           endpointRegenPriority
+	selectingRuleCount int // number of policies selecting ep, used to order within a priority tier
+}
+
+// policyReactionWorkQueue fans endpoint regenerations triggered by policy
+// rule updates out to a bounded pool of workers, instead of spawning one
+// goroutine per endpoint via ForEachGo. This avoids CPU and scheduler
+// pressure during large policy reloads, and retries failed regenerations
+// with exponential backoff, up to maxRegenRetries times, instead of
+// dropping them on the first failure.
+type policyReactionWorkQueue struct {
+	queue   workqueue.RateLimitingInterface
+	workers int
+}
+
+func newPolicyReactionWorkQueue() *policyReactionWorkQueue {
+	workers := option.Config.PolicyReactionWorkers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	return &policyReactionWorkQueue{
+		queue:   workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		workers: workers,
+	}
+}
+
+// maxRegenRetries bounds how many times a single endpoint regeneration is
+// retried with backoff before it's given up on, so that one persistently
+// failing endpoint cannot stall the policy reaction queue indefinitely.
+const maxRegenRetries = 15
+
+// run starts the worker pool and blocks until every enqueued item has been
+// terminally resolved (regenerated successfully, or given up on after
+// maxRegenRetries), then shuts the queue down. Each item's priority is used
+// only to order initial insertion; the workqueue itself provides the
+// bounded concurrency and backoff.
+func (q *policyReactionWorkQueue) run(items []regenWorkItem) {
+	sortByPriority(items)
+
+	// A workqueue ignores Add once it has been shut down, and every call
+	// shuts its queue down below, so each call starts on a fresh queue.
+	// Calls are serialized by the RuleReactionQueue.
+	q.queue = workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+
+	// pending tracks completion per-item, exactly once per item regardless
+	// of how many times it's retried. Waiting on it instead of polling
+	// queue.Len() avoids a race against AddRateLimited: a failed item's
+	// delayed re-add would otherwise read as an empty queue and let
+	// ShutDown fire before the retry is ever processed.
+	var pending sync.WaitGroup
+	pending.Add(len(items))
+
+	for i := range items {
+		q.queue.Add(&items[i])
+	}
+	metrics.PolicyRegenerationWorkqueueDepth.Set(float64(len(items)))
+
+	var wg sync.WaitGroup
+	wg.Add(q.workers)
+	for i := 0; i < q.workers; i++ {
+		go func() {
+			defer wg.Done()
+			q.worker(&pending)
+		}()
+	}
+
+	go func() {
+		pending.Wait()
+		q.queue.ShutDown()
+	}()
+	wg.Wait()
+}
+
+func (q *policyReactionWorkQueue) worker(pending *sync.WaitGroup) {
+	for {
+		item, shutdown := q.queue.Get()
+		if shutdown {
+			return
+		}
+		q.process(item.(*regenWorkItem), pending)
+		q.queue.Done(item)
+	}
+}
+
+func (q *policyReactionWorkQueue) process(item *regenWorkItem, pending *sync.WaitGroup) {
+	start := time.Now()
+	defer func() {
+		metrics.PolicyRegenerationWorkqueueLatency.Observe(time.Since(start).Seconds())
+	}()
+
+	if item.ep == nil {
+		q.queue.Forget(item)
+		pending.Done()
+		return
+	}
+
+	regenMetadata := &regeneration.ExternalRegenerationMetadata{
+		Reason:            "policy rules added",
+		RegenerationLevel: regeneration.RegenerateWithoutDatapath,
+	}
+	if err := <-item.ep.RegenerateIfAlive(regenMetadata); err != nil {
+		if q.queue.NumRequeues(item) < maxRegenRetries {
+			log.WithError(err).WithFields(logrus.Fields{
+				logfields.EndpointID:     item.ep.GetID(),
+				logfields.PolicyRevision: item.rev,
+			}).Warn("Endpoint regeneration after policy update failed, retrying with backoff")
+			q.queue.AddRateLimited(item)
+			return
+		}
+		log.WithError(err).WithFields(logrus.Fields{
+			logfields.EndpointID:     item.ep.GetID(),
+			logfields.PolicyRevision: item.rev,
+		}).Errorf("Endpoint regeneration after policy update failed %d times, giving up; endpoint policy revision may be stale", maxRegenRetries)
+		q.queue.Forget(item)
+		pending.Done()
+		return
+	}
+	q.queue.Forget(item)
+	pending.Done()
+}
+
+// sortByPriority orders items by priority tier first (host, then init, then
+// pod), and within a tier by selectingRuleCount ascending, so that the
+// common case of a few narrowly-selected endpoints isn't stuck behind
+// whatever endpoint happens to be selected by the most policies.
+func sortByPriority(items []regenWorkItem) {
+	sort.SliceStable(items, func(i, j int) bool {
+		if items[i].priority != items[j].priority {
+			return items[i].priority < items[j].priority
+		}
+		return items[i].selectingRuleCount < items[j].selectingRuleCount
+	})
+}
+
+// regenPriorityFor classifies an endpoint for the bounded worker pool: the
+// host endpoint is serviced first so the control-plane datapath is not
+// starved behind a large batch of pod endpoints, followed by endpoints still
+// completing their initial regeneration, which existing connectivity
+// doesn't yet depend on but which new connectivity is waiting on.
+func regenPriorityFor(ep *endpoint.Endpoint) endpointRegenPriority {
+	if ep.IsHost() {
+		return priorityHostEndpoint
+	}
+	if ep.IsInit() {
+		return priorityInitEndpoint
+	}
+	return priorityPodEndpoint
+}
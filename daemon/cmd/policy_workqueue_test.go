@@ -0,0 +1,29 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package cmd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSortByPriority(t *testing.T) {
+	items := []regenWorkItem{
+		{rev: 1, priority: priorityPodEndpoint, selectingRuleCount: 5},
+		{rev: 2, priority: priorityHostEndpoint, selectingRuleCount: 0},
+		{rev: 3, priority: priorityPodEndpoint, selectingRuleCount: 1},
+		{rev: 4, priority: priorityInitEndpoint, selectingRuleCount: 3},
+	}
+
+	sortByPriority(items)
+
+	// Host first, then init, then pod; within the pod tier the endpoint
+	// selected by fewer rules goes first.
+	got := make([]uint64, len(items))
+	for i, it := range items {
+		got[i] = it.rev
+	}
+	require.Equal(t, []uint64{2, 4, 3, 1}, got)
+}
@@ -0,0 +1,45 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package endpoint
+
+import (
+	"fmt"
+
+	"github.com/cilium/cilium/pkg/policy"
+)
+
+// ApplyPolicyMapDelta pushes added and removed policy map entries directly
+// into e's realized BPF policy map, without going through a full
+// regeneration. It is used by the incremental policy update path
+// (AddOptions.Incremental) to substitute a targeted diff for the full
+// regeneration an endpoint selected by newly added rules would otherwise
+// need, so the datapath catches up with the precise effect of the rules
+// just added.
+//
+// Callers are expected to invoke this for one endpoint at a time from the
+// policy reaction path, which already serializes per-endpoint work; it does
+// not take any additional lock of its own.
+//
+// There is no unit test for this function in this package. The
+// ResolveMapChanges/resolvePeerPortEntries half of the incremental path
+// that decides what to pass here is covered in
+// pkg/policy/map_changes_test.go.
+func (e *Endpoint) ApplyPolicyMapDelta(added, removed []policy.MapChange) error {
+	if e.policyMap == nil {
+		return fmt.Errorf("endpoint %d has no BPF policy map to apply an incremental delta to", e.ID)
+	}
+
+	for _, mc := range removed {
+		if err := e.policyMap.Delete(mc.Identity, mc.Port, mc.Protocol, mc.Direction); err != nil {
+			return fmt.Errorf("endpoint %d: failed to remove policy map entry for identity %d: %w", e.ID, mc.Identity, err)
+		}
+	}
+	for _, mc := range added {
+		if err := e.policyMap.Allow(mc.Identity, mc.Port, mc.Protocol, mc.Direction); err != nil {
+			return fmt.Errorf("endpoint %d: failed to add policy map entry for identity %d: %w", e.ID, mc.Identity, err)
+		}
+	}
+
+	return nil
+}
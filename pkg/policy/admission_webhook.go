@@ -0,0 +1,38 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package policy
+
+import (
+	"time"
+
+	"github.com/cilium/cilium/pkg/labels"
+)
+
+// AdmissionFailurePolicy controls what happens when a policy admission
+// webhook can't be reached or times out.
+type AdmissionFailurePolicy string
+
+const (
+	// AdmissionFailOpen lets the rule through if the webhook is unreachable.
+	AdmissionFailOpen AdmissionFailurePolicy = "fail-open"
+	// AdmissionFailClosed rejects the rule if the webhook is unreachable.
+	AdmissionFailClosed AdmissionFailurePolicy = "fail-closed"
+)
+
+// AdmissionWebhookConfig is a single external validator entry configured for
+// the policy admission chain: rules matching Selector are sent to the
+// webhook at URL for validation (and optional mutation) before PolicyAdd
+// commits them.
+//
+// This is the config-only shape held by option.Config.PolicyAdmissionWebhooks.
+// It lives here, rather than in daemon/cmd where the chain and its HTTP
+// adapter are built, so that pkg/option can declare the field without
+// importing daemon/cmd.
+type AdmissionWebhookConfig struct {
+	Name          string
+	URL           string
+	Timeout       time.Duration
+	FailurePolicy AdmissionFailurePolicy
+	Selector      labels.LabelArray // only rules matching this selector are sent to this webhook
+}
@@ -0,0 +1,206 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package policy
+
+import (
+	"strconv"
+
+	"github.com/cilium/cilium/pkg/identity"
+	"github.com/cilium/cilium/pkg/identity/cache"
+	"github.com/cilium/cilium/pkg/labels"
+	"github.com/cilium/cilium/pkg/policy/api"
+	"github.com/cilium/cilium/pkg/policy/trafficdirection"
+	"github.com/cilium/cilium/pkg/u8proto"
+)
+
+// MapChange is a single policy map entry addition or removal resulting from
+// an incremental rule update: the peer identity, L4 port, protocol and
+// traffic direction an entry should allow in an endpoint's BPF policy map,
+// or an existing entry that should be removed.
+type MapChange struct {
+	Identity  identity.NumericIdentity
+	Port      uint16
+	Protocol  u8proto.U8proto
+	Direction trafficdirection.TrafficDirection
+}
+
+// ResolveMapChanges computes the set of policy map entries that rules adds
+// to ep's policy map, without requiring ep to go through a full
+// regeneration. It is only meaningful for endpoints which rules itself
+// selects (e.g. rules.UpdateRulesEndpointsCaches put ep in
+// endpointsToRegen): this is the normal full-regeneration path, and this
+// function exists to let a caller substitute a targeted map diff for that
+// regeneration instead. Endpoints rules does not select are unaffected by
+// it and need no diff at all, incremental or otherwise.
+//
+// ok is false whenever a rule in rules that selects ep contains any
+// construct this function doesn't resolve precisely enough to diff safely:
+// deny rules (which can override allows computed elsewhere),
+// FromCIDR(Set)/FromEntities peers (which this function doesn't enumerate),
+// port ranges (EndPort) or named ports. Rather than risk
+// an Allow entry for an identity or port a full regeneration would have
+// rejected, callers must treat ok == false as "fall back to full
+// regeneration for this endpoint".
+//
+// Only the entries that rules allow are computed, so removed is always
+// empty; it is returned for symmetry with added.
+func (r *Repository) ResolveMapChanges(ep Endpoint, rules api.Rules, identities cache.IdentityCache) (added, removed []MapChange, ok bool) {
+	epLabels := ep.GetLabels()
+
+	seen := make(map[MapChange]struct{})
+	emit := func(mc MapChange) {
+		if _, ok := seen[mc]; ok {
+			return
+		}
+		seen[mc] = struct{}{}
+		added = append(added, mc)
+	}
+
+	for _, rule := range rules {
+		if !rule.EndpointSelector.Matches(epLabels) {
+			continue
+		}
+
+		// Deny rules can override an Allow computed for the very same
+		// peer/port elsewhere in the rule set; getting that precedence
+		// right requires the same evaluation a full regeneration does, not
+		// a standalone diff.
+		if len(rule.IngressDeny) > 0 || len(rule.EgressDeny) > 0 {
+			return nil, nil, false
+		}
+
+		for _, ing := range rule.Ingress {
+			if len(ing.FromCIDR) > 0 || len(ing.FromCIDRSet) > 0 || len(ing.FromEntities) > 0 {
+				return nil, nil, false
+			}
+			if !resolvePeerPortEntries(ing.FromEndpoints, ing.FromRequires, ing.ToPorts, identities, trafficdirection.Ingress, emit) {
+				return nil, nil, false
+			}
+		}
+		for _, eg := range rule.Egress {
+			if len(eg.ToCIDR) > 0 || len(eg.ToCIDRSet) > 0 || len(eg.ToEntities) > 0 {
+				return nil, nil, false
+			}
+			if !resolvePeerPortEntries(eg.ToEndpoints, eg.ToRequires, eg.ToPorts, identities, trafficdirection.Egress, emit) {
+				return nil, nil, false
+			}
+		}
+	}
+
+	return added, nil, true
+}
+
+// CountSelectingRulesLocked returns the number of rules in the repository
+// whose EndpointSelector matches ep. The caller must hold at least a read
+// lock on the repository, as with the other *Locked methods. It is used to
+// deprioritize endpoints selected by many policies in the bounded
+// regeneration worker pool: since those endpoints have proportionally more
+// work to recompute, letting them queue behind endpoints with a single
+// matching rule keeps the common case of a narrowly-scoped policy change
+// from waiting behind a few broadly-selected endpoints.
+func (r *Repository) CountSelectingRulesLocked(ep Endpoint) int {
+	epLabels := ep.GetLabels()
+
+	// An empty label filter matches every rule currently in the
+	// repository, the same convention SearchRLocked callers elsewhere (e.g.
+	// RollbackPolicyTo staging a delete of the entire rule set) rely on.
+	count := 0
+	for _, rule := range r.SearchRLocked(labels.LabelArray{}) {
+		if rule.EndpointSelector.Matches(epLabels) {
+			count++
+		}
+	}
+	return count
+}
+
+// resolvePeerPortEntries resolves peerSelectors against every identity
+// currently known to the selector cache, ANDing each match against every
+// selector in requires (api.FromRequires/ToRequires: a peer must match all
+// of them in addition to matching peerSelectors, the same semantics a full
+// regeneration enforces), and emits one MapChange per matching identity and
+// L4 port/protocol combination in toPorts. It reports false, without
+// emitting anything for this rule, if toPorts contains a port range
+// (EndPort) or a port that isn't a number (a named port): MapChange has no
+// way to represent a range, and silently collapsing one to its start port
+// would under-enforce it, while a named port only gets a numeric port when
+// the endpoint is regenerated.
+func resolvePeerPortEntries(peerSelectors, requires []api.EndpointSelector, toPorts []api.PortRule, identities cache.IdentityCache, dir trafficdirection.TrafficDirection, emit func(MapChange)) bool {
+	for _, pr := range toPorts {
+		for _, p := range pr.Ports {
+			if p.EndPort != 0 {
+				return false
+			}
+			if _, err := strconv.ParseUint(p.Port, 10, 16); err != nil {
+				return false
+			}
+		}
+	}
+
+	if len(peerSelectors) == 0 && len(requires) == 0 {
+		// No explicit peer selector: the rule allows any peer. Rather than
+		// enumerating every known identity, emit a single wildcard entry;
+		// the datapath already treats identity 0 as "any".
+		emitPortsForIdentity(identity.NumericIdentity(0), toPorts, dir, emit)
+		return true
+	}
+
+	for peerID, peerLabels := range identities {
+		if len(peerSelectors) > 0 {
+			matched := false
+			for _, sel := range peerSelectors {
+				if sel.Matches(peerLabels) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				continue
+			}
+		}
+		if !matchesAll(requires, peerLabels) {
+			continue
+		}
+		emitPortsForIdentity(peerID, toPorts, dir, emit)
+	}
+	return true
+}
+
+// matchesAll reports whether peerLabels matches every selector in
+// requires. An empty requires is vacuously satisfied by anything.
+func matchesAll(requires []api.EndpointSelector, peerLabels labels.LabelArray) bool {
+	for _, sel := range requires {
+		if !sel.Matches(peerLabels) {
+			return false
+		}
+	}
+	return true
+}
+
+func emitPortsForIdentity(id identity.NumericIdentity, toPorts []api.PortRule, dir trafficdirection.TrafficDirection, emit func(MapChange)) {
+	if len(toPorts) == 0 {
+		// No explicit L4 ports: the rule allows all of L3/L4 from/to this
+		// peer.
+		emit(MapChange{Identity: id, Direction: dir})
+		return
+	}
+
+	for _, pr := range toPorts {
+		for _, p := range pr.Ports {
+			port, err := strconv.ParseUint(p.Port, 10, 16)
+			if err != nil {
+				// Named ports are resolved per-endpoint at regeneration
+				// time and have no fixed numeric port to diff here.
+				// resolvePeerPortEntries reports false for them before
+				// getting here, so its caller falls back to a full
+				// regeneration; skip them.
+				continue
+			}
+			proto, err := u8proto.ParseProtocol(string(p.Protocol))
+			if err != nil {
+				continue
+			}
+			emit(MapChange{Identity: id, Port: uint16(port), Protocol: proto, Direction: dir})
+		}
+	}
+}
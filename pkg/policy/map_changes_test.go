@@ -0,0 +1,99 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package policy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cilium/cilium/pkg/identity"
+	"github.com/cilium/cilium/pkg/identity/cache"
+	"github.com/cilium/cilium/pkg/labels"
+	"github.com/cilium/cilium/pkg/policy/api"
+	"github.com/cilium/cilium/pkg/policy/trafficdirection"
+	"github.com/cilium/cilium/pkg/u8proto"
+)
+
+func backendSelector() api.EndpointSelector {
+	return api.NewESFromLabels(labels.ParseSelectLabel("role=backend"))
+}
+
+func prodSelector() api.EndpointSelector {
+	return api.NewESFromLabels(labels.ParseSelectLabel("env=prod"))
+}
+
+func TestResolvePeerPortEntriesNoSelectorsWildcards(t *testing.T) {
+	var got []MapChange
+	emit := func(mc MapChange) { got = append(got, mc) }
+
+	ok := resolvePeerPortEntries(nil, nil, nil, cache.IdentityCache{}, trafficdirection.Ingress, emit)
+
+	require.True(t, ok)
+	require.Equal(t, []MapChange{{Identity: identity.NumericIdentity(0), Direction: trafficdirection.Ingress}}, got)
+}
+
+// TestResolvePeerPortEntriesFromRequiresNarrowsMatch is a regression test
+// for the bypass ResolveMapChanges used to have: an identity matching
+// FromEndpoints but not an accompanying FromRequires must not get an
+// Allow entry, since a full regeneration would reject it.
+func TestResolvePeerPortEntriesFromRequiresNarrowsMatch(t *testing.T) {
+	identities := cache.IdentityCache{
+		identity.NumericIdentity(100): labels.ParseLabelArray("role=backend", "env=prod"),
+		identity.NumericIdentity(200): labels.ParseLabelArray("role=backend", "env=staging"),
+	}
+
+	var got []MapChange
+	emit := func(mc MapChange) { got = append(got, mc) }
+
+	ok := resolvePeerPortEntries(
+		[]api.EndpointSelector{backendSelector()},
+		[]api.EndpointSelector{prodSelector()},
+		nil, identities, trafficdirection.Ingress, emit)
+
+	require.True(t, ok)
+	require.Len(t, got, 1)
+	require.Equal(t, identity.NumericIdentity(100), got[0].Identity)
+}
+
+func TestResolvePeerPortEntriesEndPortBailsOut(t *testing.T) {
+	toPorts := []api.PortRule{{
+		Ports: []api.PortProtocol{{Port: "8080", EndPort: 8090, Protocol: api.ProtoTCP}},
+	}}
+
+	called := false
+	emit := func(MapChange) { called = true }
+
+	ok := resolvePeerPortEntries(nil, nil, toPorts, cache.IdentityCache{}, trafficdirection.Egress, emit)
+
+	require.False(t, ok)
+	require.False(t, called, "must not emit any entry for a rule it can't resolve precisely")
+}
+
+func TestMatchesAll(t *testing.T) {
+	peerLabels := labels.ParseLabelArray("role=backend", "env=prod")
+
+	require.True(t, matchesAll(nil, peerLabels), "an empty requires list is vacuously satisfied")
+	require.True(t, matchesAll([]api.EndpointSelector{prodSelector()}, peerLabels))
+	require.False(t, matchesAll([]api.EndpointSelector{backendSelector(), api.NewESFromLabels(labels.ParseSelectLabel("env=staging"))}, peerLabels))
+}
+
+func TestEmitPortsForIdentityNamedPortSkipped(t *testing.T) {
+	toPorts := []api.PortRule{{
+		Ports: []api.PortProtocol{
+			{Port: "http", Protocol: api.ProtoTCP}, // named port: no fixed numeric port to diff
+			{Port: "80", Protocol: api.ProtoTCP},
+		},
+	}}
+
+	tcp, err := u8proto.ParseProtocol("TCP")
+	require.NoError(t, err)
+
+	var got []MapChange
+	emitPortsForIdentity(identity.NumericIdentity(42), toPorts, trafficdirection.Ingress, func(mc MapChange) {
+		got = append(got, mc)
+	})
+
+	require.Equal(t, []MapChange{{Identity: 42, Port: 80, Protocol: tcp, Direction: trafficdirection.Ingress}}, got)
+}